@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------
+// Token-bucket budget limiter
+//
+// The budget used to be a fixed tumbling window (see getWindowKey/getWindowTTL
+// in earlier revisions), which let a whole window's budget become available
+// instantaneously at the window boundary. This refills continuously instead:
+// each bucket is a Redis hash of {tokens, last_refill_ms}, refilled at the
+// rate and capped at the capacity the caller passes (budgetRateBytesPerSec
+// and budgetBurstBytes unless a tenant or per-IP budget overrides them),
+// updated atomically in
+// Lua so concurrent requests can't race the refill math. Every touch also
+// PEXPIREs the key (ttl sized by bucketTTLMillis) so a tenant or client IP
+// that's never seen again doesn't leave its hash in Redis forever.
+// -----------------------------------------------------------------------------
+
+var (
+	budgetRateBytesPerSec float64
+	budgetBurstBytes      int64
+
+	checkBudgetScript  *redis.Script
+	refundBudgetScript *redis.Script
+)
+
+const (
+	minBucketTTLMillis int64 = 60_000     // 1 minute
+	maxBucketTTLMillis int64 = 86_400_000 // 1 day
+)
+
+// bucketTTLMillis sizes a bucket key's TTL to the time it would take to
+// refill from empty, clamped to [minBucketTTLMillis, maxBucketTTLMillis] so
+// neither a fast-refilling bucket expires mid-burst nor a slow one lives
+// unbounded. Computed in Go (rather than duplicated in the Lua scripts) so
+// it can be unit tested directly.
+func bucketTTLMillis(capacity int64, ratePerSec float64) int64 {
+	ratePerMs := ratePerSec / 1000
+	if ratePerMs <= 0 {
+		return maxBucketTTLMillis
+	}
+	ttl := int64(float64(capacity)/ratePerMs + 0.5)
+	if ttl < minBucketTTLMillis {
+		return minBucketTTLMillis
+	}
+	if ttl > maxBucketTTLMillis {
+		return maxBucketTTLMillis
+	}
+	return ttl
+}
+
+const checkBudgetLua = `
+local key = KEYS[1]
+local debit = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local rate_per_ms = tonumber(ARGV[3])
+local now_ms = tonumber(ARGV[4])
+local ttl_ms = tonumber(ARGV[5])
+
+local tokens = tonumber(redis.call("HGET", key, "tokens"))
+local last = tonumber(redis.call("HGET", key, "last_refill_ms"))
+
+if tokens == nil or last == nil then
+  tokens = capacity
+  last = now_ms
+end
+
+local elapsed = now_ms - last
+if elapsed > 0 then
+  tokens = math.min(capacity, tokens + elapsed * rate_per_ms)
+  last = now_ms
+end
+
+if tokens >= debit then
+  tokens = tokens - debit
+  redis.call("HSET", key, "tokens", tokens, "last_refill_ms", last)
+  redis.call("PEXPIRE", key, ttl_ms)
+  return {1, 0}
+end
+
+-- Denied: report how many ms until enough tokens have accumulated.
+local deficit = debit - tokens
+local wait_ms = math.ceil(deficit / rate_per_ms)
+redis.call("HSET", key, "tokens", tokens, "last_refill_ms", last)
+redis.call("PEXPIRE", key, ttl_ms)
+return {0, wait_ms}
+`
+
+const refundBudgetLua = `
+local key = KEYS[1]
+local amount = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local ttl_ms = tonumber(ARGV[3])
+
+local tokens = tonumber(redis.call("HGET", key, "tokens"))
+if tokens == nil then
+  return 0
+end
+
+tokens = math.min(capacity, tokens + amount)
+redis.call("HSET", key, "tokens", tokens)
+redis.call("PEXPIRE", key, ttl_ms)
+return 1
+`
+
+func registerBudgetScripts() {
+	checkBudgetScript = redis.NewScript(checkBudgetLua)
+	refundBudgetScript = redis.NewScript(refundBudgetLua)
+}
+
+// checkBudget atomically refills and debits the token bucket at key. allowed
+// is false when there aren't enough tokens; waitMs is then the time until
+// there will be, suitable for a Retry-After header. When debit exceeds
+// capacity the bucket never holds enough tokens, and waitMs is still the
+// deficit divided by the refill rate.
+func checkBudget(ctx context.Context, key string, debit, capacity int64, ratePerSec float64) (allowed bool, waitMs int64, err error) {
+	ttlMs := bucketTTLMillis(capacity, ratePerSec)
+	res, err := checkBudgetScript.Run(ctx, rdb, []string{key}, debit, capacity, ratePerSec/1000, time.Now().UnixMilli(), ttlMs).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	pair, ok := res.([]interface{})
+	if !ok || len(pair) != 2 {
+		return false, 0, nil
+	}
+	allowedInt, _ := pair[0].(int64)
+	wait, _ := pair[1].(int64)
+	return allowedInt == 1, wait, nil
+}
+
+// refundBudget credits amount back into the bucket at key, capped at
+// capacity, after a forwarding failure so the debit isn't held against the
+// tenant for a request that never reached the upstream. ratePerSec must match
+// the rate checkBudget was called with for key, since it's also used to size
+// the key's TTL.
+func refundBudget(ctx context.Context, key string, amount, capacity int64, ratePerSec float64, reqLogger *zap.Logger) {
+	ttlMs := bucketTTLMillis(capacity, ratePerSec)
+	if err := refundBudgetScript.Run(ctx, rdb, []string{key}, amount, capacity, ttlMs).Err(); err != nil {
+		reqLogger.Warn("failed to refund budget", zap.Int64("amount", amount), zap.String("budget_key", key), zap.Error(err))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	registerBudgetScripts()
+	return mr
+}
+
+func TestCheckBudgetAdmitsWithinCapacityAndSetsTTL(t *testing.T) {
+	mr := newTestRedis(t)
+	const key = "otel:budget:test-tenant"
+
+	allowed, waitMs, err := checkBudget(context.Background(), key, 100, 1000, 10)
+	if err != nil {
+		t.Fatalf("checkBudget returned error: %v", err)
+	}
+	if !allowed {
+		t.Fatalf("expected admit within capacity, got denied with waitMs=%d", waitMs)
+	}
+
+	// Regression check for the review comment: checkBudget must PEXPIRE the
+	// bucket key, or a tenant/IP never seen again leaves its hash in Redis
+	// forever.
+	if ttl := mr.TTL(key); ttl <= 0 {
+		t.Errorf("expected key %q to have a TTL set by checkBudget, got %v", key, ttl)
+	}
+}
+
+func TestCheckBudgetDeniesOverCapacity(t *testing.T) {
+	newTestRedis(t)
+	const key = "otel:budget:test-tenant-2"
+
+	allowed, waitMs, err := checkBudget(context.Background(), key, 2000, 1000, 10)
+	if err != nil {
+		t.Fatalf("checkBudget returned error: %v", err)
+	}
+	if allowed {
+		t.Fatalf("expected denial debiting more than capacity")
+	}
+	if waitMs <= 0 {
+		t.Errorf("expected positive waitMs on denial, got %d", waitMs)
+	}
+}
+
+func TestRefundBudgetRefreshesTTL(t *testing.T) {
+	mr := newTestRedis(t)
+	const key = "otel:budget:test-tenant-3"
+
+	if _, _, err := checkBudget(context.Background(), key, 100, 1000, 10); err != nil {
+		t.Fatalf("checkBudget returned error: %v", err)
+	}
+	mr.SetTTL(key, 0) // simulate the TTL having lapsed
+
+	refundBudget(context.Background(), key, 100, 1000, 10, zap.NewNop())
+
+	if ttl := mr.TTL(key); ttl <= 0 {
+		t.Errorf("expected refundBudget to PEXPIRE key %q, got ttl=%v", key, ttl)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestBucketTTLMillis(t *testing.T) {
+	cases := []struct {
+		name       string
+		capacity   int64
+		ratePerSec float64
+		want       int64
+	}{
+		{"fast refill clamps to floor", 1000, 1000, minBucketTTLMillis},
+		{"slow refill clamps to ceiling", 1_000_000_000, 1, maxBucketTTLMillis},
+		{"zero rate clamps to ceiling", 1_000_000, 0, maxBucketTTLMillis},
+		{"mid-range refill is exact", 60_000_000, 1_000_000, 60_000},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := bucketTTLMillis(tc.capacity, tc.ratePerSec)
+			if got != tc.want {
+				t.Errorf("bucketTTLMillis(%d, %v) = %d, want %d", tc.capacity, tc.ratePerSec, got, tc.want)
+			}
+			if got < minBucketTTLMillis || got > maxBucketTTLMillis {
+				t.Errorf("bucketTTLMillis(%d, %v) = %d, outside [%d, %d]", tc.capacity, tc.ratePerSec, got, minBucketTTLMillis, maxBucketTTLMillis)
+			}
+		})
+	}
+}
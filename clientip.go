@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------
+// Trusted-proxy-aware client IP resolution
+//
+// Behind an nginx/Caddy/ALB, r.RemoteAddr is the load balancer, not the
+// client, which collapses any per-client abuse protection to "one global
+// bucket." TRUSTED_PROXY_CIDRS lists the CIDRs of proxies allowed to set
+// X-Forwarded-For/X-Real-IP; clientIPFromRequest walks X-Forwarded-For from
+// the right (closest hop first) skipping entries inside those CIDRs, falling
+// back to X-Real-IP and finally RemoteAddr.
+// -----------------------------------------------------------------------------
+
+var trustedProxyCIDRs []*net.IPNet
+
+// loadTrustedProxyCIDRs parses TRUSTED_PROXY_CIDRS. Called from loadConfig()
+// in main.go, after baseLogger is built, so a malformed entry can be logged
+// before it's fatal.
+func loadTrustedProxyCIDRs() {
+	for _, raw := range strings.Split(os.Getenv("TRUSTED_PROXY_CIDRS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(raw)
+		if err != nil {
+			baseLogger.Fatal("invalid TRUSTED_PROXY_CIDRS entry", zap.String("value", raw), zap.Error(err))
+		}
+		trustedProxyCIDRs = append(trustedProxyCIDRs, ipnet)
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipnet := range trustedProxyCIDRs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIPFromRequest resolves the real client IP, trusting
+// X-Forwarded-For/X-Real-IP only when the request reached us through a proxy
+// listed in TRUSTED_PROXY_CIDRS. Without any trusted proxies configured, it
+// falls straight back to RemoteAddr so an untrusted client can't spoof its
+// way around the per-IP budget by setting the header itself.
+func clientIPFromRequest(r *http.Request) string {
+	remoteIP := hostFromAddr(r.RemoteAddr)
+
+	if len(trustedProxyCIDRs) == 0 {
+		return remoteIP
+	}
+
+	if ip := net.ParseIP(remoteIP); ip == nil || !isTrustedProxy(ip) {
+		return remoteIP
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			candidate := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(candidate)
+			if ip == nil {
+				continue
+			}
+			if !isTrustedProxy(ip) {
+				return candidate
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+func ipBudgetKeyFor(ip string) string {
+	return ipBudgetBucketKey + ":" + ip
+}
+
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
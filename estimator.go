@@ -1,24 +1,12 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"os"
-	"strconv"
 	"time"
-)
-
-type OtelValue struct {
-	StringValue *string  `json:"stringValue"`
-	IntValue    *string  `json:"intValue"`
-	BoolValue   *bool    `json:"boolValue"`
-	DoubleValue *float64 `json:"doubleValue"`
-}
 
-type OtelAttribute struct {
-	Key   string    `json:"key"`
-	Value OtelValue `json:"value"`
-}
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
 
 type JaegerSpan struct {
 	TraceID       string            `json:"traceID"`
@@ -42,101 +30,78 @@ type JaegerProcess struct {
 	Tags        []any             `json:"tags"`
 }
 
-type ScopeSpan struct {
-	Scope struct {
-		Name    string          `json:"name"`
-		Version string          `json:"version"`
-		Attrs   json.RawMessage `json:"attributes"`
-	} `json:"scope"`
-	Spans []struct {
-		TraceID    string          `json:"traceId"`
-		SpanID     string          `json:"spanId"`
-		Name       string          `json:"name"`
-		Kind       int             `json:"kind"`
-		Attributes json.RawMessage `json:"attributes"`
-	} `json:"spans"`
-}
-
-type ResourceSpans struct {
-	Resource struct {
-		Attributes json.RawMessage `json:"attributes"`
-	} `json:"resource"`
-	ScopeSpans []ScopeSpan `json:"scopeSpans"`
-}
-
-func EstimateHydratedSize(bodyBytes []byte) (int64, float64, int64, int) {
-	var env struct {
-		ResourceSpans []ResourceSpans `json:"resourceSpans"`
-	}
-	if err := json.Unmarshal(bodyBytes, &env); err != nil {
-		return int64(len(bodyBytes)), 1.0, int64(len(bodyBytes)), 0
+// estimateTracesSize hydrates and sizes an already-decoded TracesData.
+// handleRequest decodes the payload itself (it also needs the struct for
+// tenant extraction via resolveTenant) and calls this directly rather than
+// paying for a second unmarshal.
+func estimateTracesSize(data *tracepb.TracesData) (adj int64, spanCount int) {
+	allSpans := walkTraceSpans(data)
+	for _, s := range allSpans {
+		b, _ := json.Marshal(s)
+		adj += int64(len(b))
 	}
+	return adj, len(allSpans)
+}
 
+// walkTraceSpans hydrates every span in data into the Jaeger span shape used
+// for billing. It runs on walkResourceScopeSpans, the same OTLP visitor the
+// tail-sampling filter (filterTraceSpans) iterates, so sizing and sampling
+// share one traversal routine; each call still walks the whole message.
+func walkTraceSpans(data *tracepb.TracesData) []JaegerSpan {
 	var allSpans []JaegerSpan
 
-	for _, rs := range env.ResourceSpans {
-		resAttrs := parseAttributes(rs.Resource.Attributes)
+	walkResourceScopeSpans(data, func(rs *tracepb.ResourceSpans, ss *tracepb.ScopeSpans) {
+		resAttrs := attrsToMap(rs.GetResource().GetAttributes())
 		serviceName := resAttrs["service.name"]
 		delete(resAttrs, "service.name")
 
-		for _, ss := range rs.ScopeSpans {
-			scopeAttrs := parseAttributes(ss.Scope.Attrs)
+		scope := ss.GetScope()
+		scopeAttrs := attrsToMap(scope.GetAttributes())
 
-			for _, span := range ss.Spans {
-				spanAttrs := parseAttributes(span.Attributes)
+		for _, span := range ss.GetSpans() {
+			spanAttrs := attrsToMap(span.GetAttributes())
 
-				jaegerTag := map[string]string{
-					"otel.library.name":    ss.Scope.Name,
-					"otel.library.version": ss.Scope.Version,
-					"span.kind":            kindToString(span.Kind),
-				}
-				for _, k := range []string{"deployment.environment.name", "net.peer.name", "net.peer.port"} {
-					if v, ok := spanAttrs[k]; ok {
-						jaegerTag[k] = v
-						delete(spanAttrs, k)
-					}
+			jaegerTag := map[string]string{
+				"otel.library.name":    scope.GetName(),
+				"otel.library.version": scope.GetVersion(),
+				"span.kind":            kindToString(int32(span.GetKind())),
+			}
+			for _, k := range []string{"deployment.environment.name", "net.peer.name", "net.peer.port"} {
+				if v, ok := spanAttrs[k]; ok {
+					jaegerTag[k] = v
+					delete(spanAttrs, k)
 				}
-				jaegerTag["__HDX_API_KEY"] = "d3f19c25-c4c6-40de-968a-a2a8407eec70"
-
-				now := time.Now().UnixMilli()
-				start := now
-				duration := int64(500)
-
-				allSpans = append(allSpans, JaegerSpan{
-					TraceID:       span.TraceID,
-					SpanID:        span.SpanID,
-					OperationName: span.Name,
-					Tags:          spanAttrs,
-					JaegerTag:     jaegerTag,
-					Process: JaegerProcess{
-						ServiceName: serviceName,
-						Tag:         mergeMaps(resAttrs, scopeAttrs),
-						Tags:        []any{},
-					},
-					StartTime:   start * int64(time.Millisecond),
-					StartTimeMs: start,
-					Timestamp:   start,
-					Duration:    duration,
-					Type:        "jaegerSpan",
-					Logs:        []any{},
-					References:  []any{},
-				})
 			}
+			jaegerTag["__HDX_API_KEY"] = "d3f19c25-c4c6-40de-968a-a2a8407eec70"
+
+			now := time.Now().UnixMilli()
+
+			allSpans = append(allSpans, JaegerSpan{
+				TraceID:       hex.EncodeToString(span.GetTraceId()),
+				SpanID:        hex.EncodeToString(span.GetSpanId()),
+				OperationName: span.GetName(),
+				Tags:          spanAttrs,
+				JaegerTag:     jaegerTag,
+				Process: JaegerProcess{
+					ServiceName: serviceName,
+					Tag:         mergeMaps(resAttrs, scopeAttrs),
+					Tags:        []any{},
+				},
+				StartTime:   now * int64(time.Millisecond),
+				StartTimeMs: now,
+				Timestamp:   now,
+				Duration:    500,
+				Type:        "jaegerSpan",
+				Logs:        []any{},
+				References:  []any{},
+			})
 		}
-	}
-
-	var total int64
-	for _, s := range allSpans {
-		b, _ := json.Marshal(s)
-		total += int64(len(b))
-	}
+	})
 
-	raw := int64(len(bodyBytes))
-	factor := float64(total) / float64(raw)
-	return raw, factor, total, len(allSpans)
+	return allSpans
 }
 
-func kindToString(kind int) string {
+func kindToString(kind int32) string {
 	switch kind {
 	case 1:
 		return "internal"
@@ -153,31 +118,6 @@ func kindToString(kind int) string {
 	}
 }
 
-func parseAttributes(raw json.RawMessage) map[string]string {
-	out := map[string]string{}
-	if len(raw) <= 2 {
-		return out
-	}
-
-	var verboseAttrs []OtelAttribute
-	if err := json.Unmarshal(raw, &verboseAttrs); err != nil {
-		return out
-	}
-
-	for _, attr := range verboseAttrs {
-		if attr.Value.StringValue != nil {
-			out[attr.Key] = *attr.Value.StringValue
-		} else if attr.Value.IntValue != nil {
-			out[attr.Key] = *attr.Value.IntValue
-		} else if attr.Value.BoolValue != nil {
-			out[attr.Key] = strconv.FormatBool(*attr.Value.BoolValue)
-		} else if attr.Value.DoubleValue != nil {
-			out[attr.Key] = strconv.FormatFloat(*attr.Value.DoubleValue, 'f', -1, 64)
-		}
-	}
-	return out
-}
-
 func mergeMaps(m1, m2 map[string]string) map[string]string {
 	out := make(map[string]string, len(m1)+len(m2))
 	for k, v := range m1 {
@@ -188,4 +128,3 @@ func mergeMaps(m1, m2 map[string]string) map[string]string {
 	}
 	return out
 }
-
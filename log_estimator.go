@@ -1,49 +1,26 @@
 package main
 
 import (
-	"encoding/json"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
-func EstimateLogs(bodyBytes []byte) (raw int64, factor float64, adj int64, rows int) {
-	raw = int64(len(bodyBytes))
-
-	// Use generic decoding for logs
-	type scopeLogs struct {
-		LogRecords []json.RawMessage `json:"logRecords"`
-	}
-	type resourceLogs struct {
-		ScopeLogs []scopeLogs `json:"scopeLogs"`
-	}
-	var env struct {
-		ResourceLogs []resourceLogs `json:"resourceLogs"`
-	}
-
-	if err := json.Unmarshal(bodyBytes, &env); err != nil {
-		factor = 1.0
-		adj = raw
-		return
-	}
-
-	// We'll conservatively assume the logs transmit mostly as-is + some protocol overhead
-	// and maybe one shared process/service context. No API key or tag bloat inferred from logs
-	var totalLogBytes int64
-	for _, rl := range env.ResourceLogs {
-		for _, sl := range rl.ScopeLogs {
-			for _, logEntry := range sl.LogRecords {
-				totalLogBytes += int64(len(logEntry))
-				raws := json.RawMessage(logEntry)
-				_ = raws // no parsing yet, just size
+// estimateLogsSize sizes an already-decoded LogsData. handleRequest decodes
+// the payload itself (it also needs the struct for tenant extraction via
+// resolveTenant) and calls this directly rather than paying for a second
+// unmarshal.
+func estimateLogsSize(data *logspb.LogsData) (adj int64, rows int) {
+	// Conservatively bill the re-serialized JSON size of each log record:
+	// mostly as-is plus whatever protocol overhead its own fields carry. No
+	// API key or tag bloat is inferred from logs the way it is for traces.
+	for _, rl := range data.GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			for _, rec := range sl.GetLogRecords() {
+				b, _ := protojson.Marshal(rec)
+				adj += int64(len(b))
 				rows++
 			}
 		}
 	}
-
-	adj = totalLogBytes
-	if raw > 0 {
-		factor = float64(adj) / float64(raw)
-	} else {
-		factor = 1.0
-	}
 	return
 }
-
@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"context"
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -19,6 +18,8 @@ import (
 
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
 )
 
 // -----------------------------------------------------------------------------
@@ -27,12 +28,6 @@ import (
 
 var debugEnabled bool
 
-func debugf(format string, args ...interface{}) {
-	if debugEnabled {
-		log.Printf("[DEBUG] "+format, args...)
-	}
-}
-
 // -----------------------------------------------------------------------------
 // Globals
 // -----------------------------------------------------------------------------
@@ -41,91 +36,108 @@ var (
 	upstreamURL        *url.URL
 	authToken          string
 	budgetBytes        int64
-	budgetWindowType   string
 	failOpenSampleRate float64
 
-	rdb               *redis.Client
-	client            *http.Client
-	checkBudgetScript *redis.Script
-	ctx               = context.Background()
+	rdb    *redis.Client
+	client *http.Client
+	ctx    = context.Background()
 
 	// Concurrency-safe random number generator for fail-open logic.
 	rng      *rand.Rand
 	rngMutex sync.Mutex
-)
 
-// -----------------------------------------------------------------------------
-// Lua script: atomic budget check
-// -----------------------------------------------------------------------------
-
-const checkBudgetLua = `
-local key = KEYS[1]
-local debit_amount = tonumber(ARGV[1])
-local budget = tonumber(ARGV[2])
-local ttl_ms = tonumber(ARGV[3])
-
--- Atomically check for key existence and set with initial value and TTL if it doesn't exist.
--- This prevents a race condition where multiple requests could set the key simultaneously.
-if redis.call("EXISTS", key) == 0 then
-    -- Set initial value to 0 with the specified TTL in milliseconds.
-    -- The 'NX' option ensures this only happens if the key does not exist.
-    redis.call("SET", key, 0, "PX", ttl_ms, "NX")
-end
-
-local current_usage = redis.call("INCRBY", key, debit_amount)
+	perIPBudgetEnabled   bool
+	perIPRateBytesPerSec float64
+	perIPBurstBytes      int64
+)
 
-if current_usage > budget then
-  -- If over budget, revert the increment and return 0 (denied).
-  redis.call("DECRBY", key, debit_amount)
-  return 0
-end
+const ipBudgetBucketKey = "otel:ipbudget"
 
--- Return 1 (allowed).
-return 1
-`
+const budgetBucketKey = "otel:budget"
 
 // -----------------------------------------------------------------------------
-// init()
+// loadConfig
+//
+// This used to be a package-level init(), but Go runs init() for every build
+// of the package -- including `go test`, for test files that touch neither
+// Redis nor HTTP. That meant the whole suite (and a vanilla `go test ./...`
+// in CI) hard-crashed on baseLogger.Fatal before a single test ran unless
+// production secrets were exported and a live Redis was reachable. Called
+// explicitly from main() instead, so tests never hit it.
 // -----------------------------------------------------------------------------
 
-func init() {
+func loadConfig() {
 	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
 	case "debug", "trace":
 		debugEnabled = true
-		log.Println("Log level: DEBUG")
 	default:
 		debugEnabled = false
 	}
+	initLogger()
+	if debugEnabled {
+		baseLogger.Info("Log level: DEBUG")
+	}
 
 	ingestURLStr := os.Getenv("OTEL_INGEST_URL")
 	if ingestURLStr == "" {
-		log.Fatal("FATAL: OTEL_INGEST_URL not set")
+		baseLogger.Fatal("OTEL_INGEST_URL not set")
 	}
 	var err error
 	upstreamURL, err = url.Parse(ingestURLStr)
 	if err != nil {
-		log.Fatalf("FATAL: invalid OTEL_INGEST_URL: %v", err)
+		baseLogger.Fatal("invalid OTEL_INGEST_URL", zap.Error(err))
 	}
 
 	authToken = os.Getenv("OTEL_INGEST_TOKEN")
 	if authToken == "" {
-		log.Fatal("FATAL: OTEL_INGEST_TOKEN not set")
+		baseLogger.Fatal("OTEL_INGEST_TOKEN not set")
 	}
 
 	mbStr := os.Getenv("MAX_MEGABYTES_PER_WINDOW")
 	if mbStr == "" {
-		log.Fatal("FATAL: MAX_MEGABYTES_PER_WINDOW not set")
+		baseLogger.Fatal("MAX_MEGABYTES_PER_WINDOW not set")
 	}
 	mb, err := strconv.ParseInt(mbStr, 10, 64)
 	if err != nil {
-		log.Fatalf("FATAL: invalid MAX_MEGABYTES_PER_WINDOW: %v", err)
+		baseLogger.Fatal("invalid MAX_MEGABYTES_PER_WINDOW", zap.Error(err))
 	}
 	budgetBytes = mb * 1000 * 1000 // decimal MB
 
-	budgetWindowType = strings.ToLower(os.Getenv("BUDGET_WINDOW_TYPE"))
-	if budgetWindowType != "hourly" && budgetWindowType != "daily" {
-		budgetWindowType = "hourly"
-		log.Println("Defaulting BUDGET_WINDOW_TYPE to 'hourly'")
+	// BUDGET_RATE_BYTES_PER_SEC / BUDGET_BURST_BYTES drive the token-bucket
+	// limiter. Default them off MAX_MEGABYTES_PER_WINDOW so existing
+	// deployments get a comparable steady-state rate (budget spent over the
+	// previously configured window) with a one-minute burst allowance
+	// instead of the whole window. BUDGET_WINDOW_TYPE is gone now that the
+	// window concept itself is gone, but a leftover "daily" from the old
+	// fixed-window config must still scale the default rate down 24x, or
+	// upgrading silently turns a daily budget into an hourly one.
+	windowSeconds := 3600.0
+	switch strings.ToLower(os.Getenv("BUDGET_WINDOW_TYPE")) {
+	case "", "hourly":
+		// default
+	case "daily":
+		windowSeconds = 86400
+	default:
+		baseLogger.Fatal("BUDGET_WINDOW_TYPE is no longer used; remove it (or set it to \"hourly\"/\"daily\" to carry over the old window length into BUDGET_RATE_BYTES_PER_SEC's default)",
+			zap.String("value", os.Getenv("BUDGET_WINDOW_TYPE")))
+	}
+	defaultRate := float64(budgetBytes) / windowSeconds
+	budgetRateBytesPerSec = defaultRate
+	if v := os.Getenv("BUDGET_RATE_BYTES_PER_SEC"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			baseLogger.Fatal("invalid BUDGET_RATE_BYTES_PER_SEC", zap.String("value", v))
+		}
+		budgetRateBytesPerSec = f
+	}
+
+	budgetBurstBytes = int64(defaultRate * 60)
+	if v := os.Getenv("BUDGET_BURST_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			baseLogger.Fatal("invalid BUDGET_BURST_BYTES", zap.String("value", v))
+		}
+		budgetBurstBytes = n
 	}
 
 	if v := os.Getenv("FAIL_OPEN_SAMPLE_RATE"); v != "" {
@@ -134,20 +146,44 @@ func init() {
 		}
 	}
 
+	tenantHeader = os.Getenv("TENANT_HEADER")
+	if tenantHeader == "" {
+		tenantHeader = "X-Tenant-Id"
+	}
+	budgetsConfigPath = os.Getenv("BUDGETS_CONFIG_PATH")
+	loadBudgetsConfig()
+
+	loadTrustedProxyCIDRs()
+
+	// PER_IP_BUDGET_MB_PER_WINDOW gates an optional secondary budget, keyed
+	// by client IP rather than tenant, to stop a single abusive client from
+	// hiding behind a well-behaved tenant's budget. It derives rate/burst the
+	// same way the main budget derives them from MAX_MEGABYTES_PER_WINDOW.
+	if v := os.Getenv("PER_IP_BUDGET_MB_PER_WINDOW"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb <= 0 {
+			baseLogger.Fatal("invalid PER_IP_BUDGET_MB_PER_WINDOW", zap.String("value", v))
+		}
+		perIPBudgetEnabled = true
+		perIPRate := float64(mb*1000*1000) / windowSeconds
+		perIPRateBytesPerSec = perIPRate
+		perIPBurstBytes = int64(perIPRate * 60)
+	}
+
 	redisURLStr := os.Getenv("REDIS_URL")
 	if redisURLStr == "" {
-		log.Fatal("FATAL: REDIS_URL not set")
+		baseLogger.Fatal("REDIS_URL not set")
 	}
 	opt, err := redis.ParseURL(redisURLStr)
 	if err != nil {
-		log.Fatalf("FATAL: invalid REDIS_URL: %v", err)
+		baseLogger.Fatal("invalid REDIS_URL", zap.Error(err))
 	}
 	rdb = redis.NewClient(opt)
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Fatalf("FATAL: cannot connect to Redis: %v", err)
+		baseLogger.Fatal("cannot connect to Redis", zap.Error(err))
 	}
 
-	checkBudgetScript = redis.NewScript(checkBudgetLua)
+	registerBudgetScripts()
 
 	client = &http.Client{
 		Timeout: 15 * time.Second,
@@ -161,7 +197,12 @@ func init() {
 	// Initialize the concurrency-safe random number generator.
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	log.Printf("Proxy configured. Budget: %d bytes/%s. Upstream: %s", budgetBytes, budgetWindowType, upstreamURL.Host)
+	baseLogger.Info("Proxy configured",
+		zap.Float64("budget_rate_bytes_per_sec", budgetRateBytesPerSec),
+		zap.Int64("budget_burst_bytes", budgetBurstBytes),
+		zap.Bool("per_ip_budget_enabled", perIPBudgetEnabled),
+		zap.String("upstream", upstreamURL.Host),
+	)
 }
 
 // -----------------------------------------------------------------------------
@@ -169,6 +210,8 @@ func init() {
 // -----------------------------------------------------------------------------
 
 func main() {
+	loadConfig()
+
 	mux := http.NewServeMux()
 	server := &http.Server{
 		Addr:              ":4318",
@@ -179,27 +222,37 @@ func main() {
 	mux.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { w.Write([]byte("ok")) })
 	mux.Handle("/metrics", promhttp.Handler())
 
-	mux.HandleFunc("/v1/traces", handleRequest)
-	mux.HandleFunc("/v1/logs", handleRequest)
-	mux.HandleFunc("/v1/metrics", handleMetricsPassthrough)
+	mux.HandleFunc("/v1/traces", withRequestLogger("/v1/traces", handleRequest(signalTraces)))
+	mux.HandleFunc("/v1/logs", withRequestLogger("/v1/logs", handleRequest(signalLogs)))
+	mux.HandleFunc("/v1/metrics", withRequestLogger("/v1/metrics", handleMetricsPassthrough))
 
 	go func() {
-		log.Println("Proxy listening on :4318")
+		baseLogger.Info("Proxy listening", zap.String("addr", ":4318"))
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+			baseLogger.Fatal("listen failed", zap.Error(err))
+		}
+	}()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			baseLogger.Info("SIGHUP received, reloading budgets config")
+			loadBudgetsConfig()
 		}
 	}()
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
-	log.Println("Shutdown signal received, gracefully shutting down...")
+	baseLogger.Info("Shutdown signal received, gracefully shutting down...")
 	ctxShut, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctxShut); err != nil {
-		log.Fatalf("Server shutdown failed: %+v", err)
+		baseLogger.Fatal("Server shutdown failed", zap.Error(err))
 	}
-	log.Println("Server exited properly")
+	baseLogger.Info("Server exited properly")
+	_ = baseLogger.Sync()
 }
 
 // -----------------------------------------------------------------------------
@@ -207,131 +260,253 @@ func main() {
 // -----------------------------------------------------------------------------
 
 func handleMetricsPassthrough(w http.ResponseWriter, r *http.Request) {
-	upstreamStatus, err := forwardRequest(r, r.Body, r.ContentLength)
+	reqLogger := loggerFromContext(r.Context())
+	upstreamStatus, err := forwardRequest(r, r.Body, r.ContentLength, reqLogger)
 	if err != nil {
-		log.Printf("ERROR: failed to forward metrics request: %v", err)
+		reqLogger.Error("failed to forward metrics request", zap.Error(err))
 		http.Error(w, "Failed to forward request", http.StatusBadGateway)
 		return
 	}
 	w.WriteHeader(upstreamStatus)
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// OTLP signal kinds handleRequest is parameterized over, so the same
+// budget/forward plumbing serves both /v1/traces and /v1/logs.
+const (
+	signalTraces = "traces"
+	signalLogs   = "logs"
+)
 
-	// 1. Content-Type Validation
-	contentType := r.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "application/json") {
-		http.Error(w, "Unsupported Content-Type: must be application/json", http.StatusUnsupportedMediaType)
-		return
-	}
+func handleRequest(signal string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		clientIP := clientIPFromRequest(r)
+		reqLogger := loggerFromContext(r.Context()).With(zap.String("client_ip", clientIP))
 
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "failed to read request body", http.StatusInternalServerError)
-		return
-	}
-	if len(bodyBytes) == 0 {
-		w.WriteHeader(http.StatusAccepted)
-		return
-	}
+		// 1. Content-Type Validation: accept OTLP/JSON and OTLP/protobuf.
+		contentType := r.Header.Get("Content-Type")
+		if !strings.HasPrefix(contentType, "application/json") && !isProtobufContentType(contentType) {
+			http.Error(w, "Unsupported Content-Type: must be application/json or application/x-protobuf", http.StatusUnsupportedMediaType)
+			return
+		}
 
-	// 2. Large Body Guard: Skip estimator for very large payloads to prevent OOM.
-	const maxBodyForEstimate = 15 * 1024 * 1024 // 15 MiB
-	var adjSize int64
-	if len(bodyBytes) > maxBodyForEstimate {
-		log.Printf("WARN: Large body (%d bytes), skipping estimator. Billing raw size.", len(bodyBytes))
-		// Fallback to billing raw compressed size + headers
-		adjSize = int64(len(bodyBytes)) + 200
-	} else {
-		var jsonBytes []byte
-		if r.Header.Get("Content-Encoding") == "gzip" {
-			zr, err := gzip.NewReader(bytes.NewReader(bodyBytes))
-			if err != nil {
-				http.Error(w, "failed to create gzip reader", http.StatusBadRequest)
-				return
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		if len(bodyBytes) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// --- per-client-IP abuse guard, independent of tenant budgets ---
+		// Checked against raw body size, before decoding, so an abusive
+		// client is rejected as cheaply as possible and never reaches the
+		// tenant budget it might otherwise be hiding behind.
+		ipBudgetKey := ipBudgetKeyFor(clientIP)
+		ipRedisCheckPassed := false
+		if perIPBudgetEnabled {
+			ipAllowed, ipWaitMs, ipErr := checkBudget(ctx, ipBudgetKey, int64(len(bodyBytes)), perIPBurstBytes, perIPRateBytesPerSec)
+			if ipErr == nil {
+				if !ipAllowed {
+					ipBudgetDeniedTotal.Inc()
+					w.Header().Set("Retry-After", strconv.FormatInt((ipWaitMs+999)/1000, 10))
+					w.Header().Set("X-Budget-Denied-Reason", "ip")
+					http.Error(w, "Per-IP budget exceeded", http.StatusTooManyRequests)
+					return
+				}
+				ipRedisCheckPassed = true
+			} else {
+				reqLogger.Warn("per-IP budget check failed, failing open", zap.Error(ipErr))
 			}
-			jsonBytes, err = io.ReadAll(zr)
-			zr.Close() // Close the reader as soon as we are done with it.
-			if err != nil {
-				http.Error(w, "failed to decompress gzip body", http.StatusBadRequest)
-				return
+		}
+		// refundIPBudget undoes the per-IP debit above when the request ends
+		// up not reaching the upstream for an unrelated reason (tenant
+		// budget denial, forwarding error), so IP abuse protection doesn't
+		// also penalize well-behaved retries.
+		refundIPBudget := func() {
+			if ipRedisCheckPassed {
+				refundBudget(ctx, ipBudgetKey, int64(len(bodyBytes)), perIPBurstBytes, perIPRateBytesPerSec, reqLogger)
 			}
-		} else {
-			jsonBytes = bodyBytes
 		}
-		// Estimate hydrated size from the uncompressed JSON.
-		_, _, adjSize, _ = EstimateHydratedSize(jsonBytes)
-	}
-
-	// --- optimistic budget check ---
-	key := "otel:budget:" + getWindowKey()
-	ttl := getWindowTTL().Milliseconds()
-	redisCheckPassed := false
 
-	res, err := checkBudgetScript.Run(ctx, rdb, []string{key}, adjSize, budgetBytes, ttl).Result()
-	if err != nil {
-		// 3. Concurrency-Safe Fail-Open Logic
-		rngMutex.Lock()
-		shouldFailOpen := rng.Float64() < failOpenSampleRate
-		rngMutex.Unlock()
-
-		if failOpenSampleRate > 0 && shouldFailOpen {
-			log.Printf("WARN: Redis unavailable, failing open for request. Error: %v", err)
-			// Fallthrough to forward the request without budget check.
+		headerTenant := r.Header.Get(tenantHeader)
+		gzipped := r.Header.Get("Content-Encoding") == "gzip"
+
+		// 2. Large Body Guard: Skip estimator for very large payloads to prevent OOM.
+		const maxBodyForEstimate = 15 * 1024 * 1024 // 15 MiB
+		var adjSize int64
+		var spanCount int
+		var tracesData *tracepb.TracesData // kept for the tail-sampling fallback below
+		tenant := headerTenant
+		if len(bodyBytes) > maxBodyForEstimate {
+			reqLogger.Warn("large body, skipping estimator, billing raw size", zap.Int("raw_size", len(bodyBytes)))
+			// Fallback to billing raw compressed size + headers
+			adjSize = int64(len(bodyBytes)) + 200
+			if tenant == "" {
+				tenant = defaultTenant
+			}
 		} else {
-			log.Printf("ERROR: Redis budget check failed: %v", err)
-			http.Error(w, "error checking budget", http.StatusServiceUnavailable)
-			return
+			var payload []byte
+			if gzipped {
+				zr, err := gzip.NewReader(bytes.NewReader(bodyBytes))
+				if err != nil {
+					refundIPBudget()
+					http.Error(w, "failed to create gzip reader", http.StatusBadRequest)
+					return
+				}
+				payload, err = io.ReadAll(zr)
+				zr.Close() // Close the reader as soon as we are done with it.
+				if err != nil {
+					refundIPBudget()
+					http.Error(w, "failed to decompress gzip body", http.StatusBadRequest)
+					return
+				}
+			} else {
+				payload = bodyBytes
+			}
+			// Decode once so tenant extraction and size estimation share the
+			// same in-memory OTLP struct instead of parsing the payload twice.
+			if signal == signalLogs {
+				data, err := decodeLogs(payload, contentType)
+				if err != nil {
+					adjSize = int64(len(payload))
+					if tenant == "" {
+						tenant = defaultTenant
+					}
+				} else {
+					tenant = resolveTenant(headerTenant, data)
+					adjSize, spanCount = estimateLogsSize(data)
+				}
+			} else {
+				data, err := decodeTraces(payload, contentType)
+				if err != nil {
+					adjSize = int64(len(payload))
+					if tenant == "" {
+						tenant = defaultTenant
+					}
+				} else {
+					tenant = resolveTenant(headerTenant, data)
+					adjSize, spanCount = estimateTracesSize(data)
+					tracesData = data
+				}
+			}
 		}
-	} else {
-		if allowed, _ := res.(int64); allowed == 1 {
+
+		// --- optimistic budget check ---
+		tenant = sanitizeTenant(tenant)
+		key := budgetKeyFor(tenant)
+		rate, burst := tenantBudgetRate(tenant)
+		redisCheckPassed := false
+		forwardBody := bodyBytes
+
+		reqLogger = reqLogger.With(
+			zap.String("tenant", tenant),
+			zap.String("budget_key", key),
+			zap.Int64("raw_size", int64(len(bodyBytes))),
+			zap.Int64("adj_size", adjSize),
+			zap.Int("span_count", spanCount),
+		)
+
+		allowed, waitMs, err := checkBudget(ctx, key, adjSize, burst, rate)
+		if err != nil {
+			// 3. Concurrency-Safe Fail-Open Logic
+			rngMutex.Lock()
+			shouldFailOpen := rng.Float64() < failOpenSampleRate
+			rngMutex.Unlock()
+
+			if failOpenSampleRate > 0 && shouldFailOpen {
+				reqLogger.Warn("Redis unavailable, failing open for request", zap.Error(err))
+				// Fallthrough to forward the request without budget check.
+			} else {
+				reqLogger.Error("Redis budget check failed", zap.Error(err))
+				refundIPBudget()
+				http.Error(w, "error checking budget", http.StatusServiceUnavailable)
+				return
+			}
+		} else if allowed {
+			redisCheckPassed = true
+			budgetBytesUsedTotal.WithLabelValues(tenant).Add(float64(adjSize))
+		} else if tailSamplingEnabled && tracesData != nil {
+			// Degraded mode: drop low-priority spans and re-check the
+			// reduced size instead of rejecting the whole batch outright.
+			kept, total := sampleTraces(tracesData, samplingDefaultKeepRate)
+			sampledAdjSize, _ := estimateTracesSize(tracesData)
+
+			sampledAllowed, sampledWaitMs, sampleErr := checkBudget(ctx, key, sampledAdjSize, burst, rate)
+			if sampleErr != nil || !sampledAllowed {
+				refundIPBudget()
+				budgetDeniedTotal.WithLabelValues(tenant).Inc()
+				waitMsToReport := waitMs
+				if sampleErr == nil {
+					waitMsToReport = sampledWaitMs
+				}
+				w.Header().Set("Retry-After", strconv.FormatInt((waitMsToReport+999)/1000, 10))
+				http.Error(w, "Budget exceeded", http.StatusTooManyRequests)
+				return
+			}
+
+			reduced, err := marshalTraces(tracesData, contentType)
+			if err != nil {
+				refundIPBudget()
+				refundBudget(ctx, key, sampledAdjSize, burst, rate, reqLogger)
+				reqLogger.Error("failed to re-serialize sampled traces", zap.Error(err))
+				budgetDeniedTotal.WithLabelValues(tenant).Inc()
+				http.Error(w, "Budget exceeded", http.StatusTooManyRequests)
+				return
+			}
+			if gzipped {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				_, _ = zw.Write(reduced)
+				zw.Close()
+				reduced = buf.Bytes()
+			}
+
 			redisCheckPassed = true
+			adjSize = sampledAdjSize
+			forwardBody = reduced
+			budgetBytesUsedTotal.WithLabelValues(tenant).Add(float64(adjSize))
+			budgetSampledSpansTotal.WithLabelValues(tenant).Add(float64(total - kept))
+			w.Header().Set("X-Budget-Sampled", strconv.Itoa(kept)+"/"+strconv.Itoa(total))
+			reqLogger.Debug("tail-sampled request", zap.Int("kept_spans", kept), zap.Int("total_spans", total))
 		} else {
+			refundIPBudget()
+			budgetDeniedTotal.WithLabelValues(tenant).Inc()
+			w.Header().Set("Retry-After", strconv.FormatInt((waitMs+999)/1000, 10))
 			http.Error(w, "Budget exceeded", http.StatusTooManyRequests)
 			return
 		}
-	}
 
-	// --- forward original (potentially compressed) request ---
-	status, fwdErr := forwardRequest(r, bytes.NewReader(bodyBytes), int64(len(bodyBytes)))
-	if fwdErr != nil || status >= 300 {
-		if redisCheckPassed {
-			_ = rdb.DecrBy(ctx, key, adjSize)
-			debugf("refunded %d from %s due to forwarding error", adjSize, key)
-		}
+		// --- forward the (possibly sampled) request. Non-sampled requests
+		// forward the original bytes untouched, compressed or not, protobuf
+		// or not, so downstream decoding still works. ---
+		status, fwdErr := forwardRequest(r, bytes.NewReader(forwardBody), int64(len(forwardBody)), reqLogger)
+		if fwdErr != nil || status >= 300 {
+			refundIPBudget()
+			if redisCheckPassed {
+				refundBudget(ctx, key, adjSize, burst, rate, reqLogger)
+				reqLogger.Debug("refunded budget due to forwarding error", zap.Int64("amount", adjSize))
+			}
 
-		if fwdErr != nil {
-			http.Error(w, "failed to forward request", http.StatusBadGateway)
-		} else {
-			w.WriteHeader(status)
+			if fwdErr != nil {
+				http.Error(w, "failed to forward request", http.StatusBadGateway)
+			} else {
+				w.WriteHeader(status)
+			}
+			return
 		}
-		return
-	}
 
-	w.WriteHeader(status)
+		w.WriteHeader(status)
+	}
 }
 
 // -----------------------------------------------------------------------------
 // helper fns
 // -----------------------------------------------------------------------------
 
-func getWindowKey() string {
-	now := time.Now().UTC()
-	if budgetWindowType == "daily" {
-		return now.Format("2006-01-02")
-	}
-	return now.Format("2006-01-02T15") // Hourly key
-}
-
-func getWindowTTL() time.Duration {
-	if budgetWindowType == "daily" {
-		return 24*time.Hour + 5*time.Minute
-	}
-	return time.Hour + 5*time.Minute
-}
-
-func forwardRequest(orig *http.Request, body io.Reader, size int64) (int, error) {
+func forwardRequest(orig *http.Request, body io.Reader, size int64, reqLogger *zap.Logger) (int, error) {
 	dest := upstreamURL.ResolveReference(orig.URL)
 	req, err := http.NewRequestWithContext(orig.Context(), orig.Method, dest.String(), body)
 	if err != nil {
@@ -355,9 +530,8 @@ func forwardRequest(orig *http.Request, body io.Reader, size int64) (int, error)
 
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
-		log.Printf("Upstream returned status %d: %s", resp.StatusCode, string(b))
+		reqLogger.Warn("upstream returned non-2xx status", zap.Int("status", resp.StatusCode), zap.String("body", string(b)))
 	}
 
 	return resp.StatusCode, nil
 }
-
@@ -0,0 +1,32 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	budgetBytesUsedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "otel_budget_bytes_used_total",
+		Help: "Total adjusted bytes debited from the budget, by tenant.",
+	}, []string{"tenant"})
+
+	budgetDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "otel_budget_denied_total",
+		Help: "Total requests denied by the budget limiter, by tenant.",
+	}, []string{"tenant"})
+
+	budgetSampledSpansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "otel_budget_sampled_spans_total",
+		Help: "Total spans dropped by the tail-sampling fallback, by tenant.",
+	}, []string{"tenant"})
+
+	// Not labeled by tenant or IP: a per-client-IP denial is abuse
+	// protection, not a tenant's billing signal, and per-IP cardinality
+	// would be unbounded on a Prometheus label.
+	ipBudgetDeniedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "otel_ip_budget_denied_total",
+		Help: "Total requests denied by the per-client-IP secondary budget.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(budgetBytesUsedTotal, budgetDeniedTotal, budgetSampledSpansTotal, ipBudgetDeniedTotal)
+}
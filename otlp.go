@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// -----------------------------------------------------------------------------
+// OTLP wire-format decoding
+//
+// The proxy accepts both OTLP/JSON and OTLP/protobuf. Since OTLP's JSON
+// encoding is protojson-compatible, both wire formats decode into the same
+// generated OTLP message types, which lets the estimators in estimator.go and
+// log_estimator.go walk a single in-memory representation regardless of how
+// the client encoded the batch.
+// -----------------------------------------------------------------------------
+
+func isProtobufContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/x-protobuf")
+}
+
+// protojsonUnmarshalOpts discards fields this vendored proto version doesn't
+// know about, matching proto.Unmarshal's forward-compatible behavior on the
+// protobuf path -- otherwise a client sending a newer OTLP field over JSON
+// fails to decode and falls back to raw-size billing while the identical
+// payload over protobuf decodes and bills normally.
+var protojsonUnmarshalOpts = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+func decodeTraces(body []byte, contentType string) (*tracepb.TracesData, error) {
+	data := &tracepb.TracesData{}
+	if isProtobufContentType(contentType) {
+		if err := proto.Unmarshal(body, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	if err := protojsonUnmarshalOpts.Unmarshal(body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func decodeLogs(body []byte, contentType string) (*logspb.LogsData, error) {
+	data := &logspb.LogsData{}
+	if isProtobufContentType(contentType) {
+		if err := proto.Unmarshal(body, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	if err := protojsonUnmarshalOpts.Unmarshal(body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// walkResourceScopeSpans is the shared OTLP visitor over
+// ResourceSpans->ScopeSpans: both the Jaeger-hydration walk
+// (walkTraceSpans, used for billing) and the tail-sampling filter
+// (filterTraceSpans) iterate this same shape, the former to size every span
+// and the latter to decide which survive.
+func walkResourceScopeSpans(data *tracepb.TracesData, visit func(rs *tracepb.ResourceSpans, ss *tracepb.ScopeSpans)) {
+	for _, rs := range data.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			visit(rs, ss)
+		}
+	}
+}
+
+// attrsToMap flattens an OTLP attribute list into the string-only map shape
+// the Jaeger hydration model expects. Non-scalar values (arrays, kvlists,
+// bytes) are dropped rather than guessed at.
+func attrsToMap(attrs []*commonpb.KeyValue) map[string]string {
+	out := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		if s, ok := anyValueToString(kv.GetValue()); ok {
+			out[kv.GetKey()] = s
+		}
+	}
+	return out
+}
+
+func anyValueToString(v *commonpb.AnyValue) (string, bool) {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue, true
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(val.IntValue, 10), true
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(val.BoolValue), true
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(val.DoubleValue, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
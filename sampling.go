@@ -0,0 +1,133 @@
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// -----------------------------------------------------------------------------
+// Tail-sampling fallback
+//
+// A hard 429 on budget exhaustion means the client drops the whole batch,
+// losing every span for the rest of the window -- including the errors an
+// operator most needs. When the budget denies a traces payload, trim it down
+// to the spans a priority filter says matter and re-check the reduced size
+// before giving up and rejecting outright.
+// -----------------------------------------------------------------------------
+
+var (
+	tailSamplingEnabled     bool
+	slowClientThreshold     time.Duration
+	samplingDefaultKeepRate float64
+)
+
+func init() {
+	tailSamplingEnabled = true
+	if v := os.Getenv("TAIL_SAMPLING_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			tailSamplingEnabled = b
+		}
+	}
+
+	slowClientThreshold = 500 * time.Millisecond
+	if v := os.Getenv("SAMPLING_SLOW_CLIENT_THRESHOLD_MS"); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+			slowClientThreshold = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	samplingDefaultKeepRate = 0.1
+	if v := os.Getenv("SAMPLING_DEFAULT_KEEP_RATIO"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			samplingDefaultKeepRate = f
+		}
+	}
+}
+
+// spanPriority reports whether span must always be kept regardless of its
+// trace's probabilistic keep/drop decision: errors, root server spans, and
+// slow client calls are the signal operators reach for first.
+func spanPriority(span *tracepb.Span) bool {
+	if span.GetStatus().GetCode() == tracepb.Status_STATUS_CODE_ERROR {
+		return true
+	}
+	if span.GetKind() == tracepb.Span_SPAN_KIND_SERVER && len(span.GetParentSpanId()) == 0 {
+		return true
+	}
+	if span.GetKind() == tracepb.Span_SPAN_KIND_CLIENT {
+		duration := time.Duration(span.GetEndTimeUnixNano()-span.GetStartTimeUnixNano()) * time.Nanosecond
+		if duration >= slowClientThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// traceKeptByHash deterministically decides, per traceId, whether the
+// non-priority remainder of a trace survives sampling. Hashing traceId
+// (rather than flipping a coin per span) keeps whole traces together instead
+// of leaving a span missing from the middle of a trace that otherwise
+// survived.
+func traceKeptByHash(traceID []byte, keepRate float64) bool {
+	if keepRate >= 1 {
+		return true
+	}
+	if keepRate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(traceID)
+	return float64(h.Sum64())/float64(^uint64(0)) < keepRate
+}
+
+// filterTraceSpans walks data via walkResourceScopeSpans -- the same OTLP
+// visitor walkTraceSpans uses to hydrate spans for billing -- keeping each
+// span iff keep reports true, and reports how many of the total it kept.
+// Spans are filtered in place.
+func filterTraceSpans(data *tracepb.TracesData, keep func(span *tracepb.Span) bool) (kept, total int) {
+	walkResourceScopeSpans(data, func(_ *tracepb.ResourceSpans, ss *tracepb.ScopeSpans) {
+		filtered := ss.GetSpans()[:0]
+		for _, span := range ss.GetSpans() {
+			total++
+			if keep(span) {
+				filtered = append(filtered, span)
+				kept++
+			}
+		}
+		ss.Spans = filtered
+	})
+	return kept, total
+}
+
+// sampleTraces applies the default priority rules to data, in place, and
+// returns how many spans were kept out of the total seen.
+func sampleTraces(data *tracepb.TracesData, keepRate float64) (kept, total int) {
+	traceDecision := make(map[string]bool)
+	return filterTraceSpans(data, func(span *tracepb.Span) bool {
+		if spanPriority(span) {
+			return true
+		}
+		id := string(span.GetTraceId())
+		decision, ok := traceDecision[id]
+		if !ok {
+			decision = traceKeptByHash(span.GetTraceId(), keepRate)
+			traceDecision[id] = decision
+		}
+		return decision
+	})
+}
+
+// marshalTraces re-serializes data in the same wire format it was decoded
+// from, so the trimmed payload forwarded downstream still decodes correctly.
+func marshalTraces(data *tracepb.TracesData, contentType string) ([]byte, error) {
+	if isProtobufContentType(contentType) {
+		return proto.Marshal(data)
+	}
+	return protojson.Marshal(data)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------------------------------------------------------
+// Per-tenant budgets
+//
+// Without this, a single noisy service starves every other service behind
+// the proxy, since there was only ever one global budget bucket. Requests are
+// attributed to a tenant either via an explicit header or, failing that, by
+// cheaply peeking at the first ResourceSpans/ResourceLogs' service.name
+// without running the (expensive) Jaeger hydration pass. Each tenant gets its
+// own token-bucket key and, optionally, its own rate/burst from
+// BUDGETS_CONFIG_PATH.
+// -----------------------------------------------------------------------------
+
+const defaultTenant = "default"
+
+var (
+	tenantHeader      string
+	budgetsConfigPath string
+
+	budgetsMu  sync.RWMutex
+	budgetsCfg budgetsConfig
+)
+
+type tenantBudget struct {
+	RateBytesPerSec float64 `yaml:"rate_bytes_per_sec" json:"rate_bytes_per_sec"`
+	BurstBytes      int64   `yaml:"burst_bytes" json:"burst_bytes"`
+}
+
+type budgetsConfig struct {
+	Default tenantBudget            `yaml:"default" json:"default"`
+	Tenants map[string]tenantBudget `yaml:"tenants" json:"tenants"`
+}
+
+// loadBudgetsConfig reads and parses BUDGETS_CONFIG_PATH, if set, replacing
+// the in-memory per-tenant budget table. It's safe to call concurrently with
+// tenantBudgetRate via budgetsMu, and is what the SIGHUP handler in main()
+// calls to reload without a restart.
+func loadBudgetsConfig() {
+	if budgetsConfigPath == "" {
+		return
+	}
+
+	raw, err := os.ReadFile(budgetsConfigPath)
+	if err != nil {
+		baseLogger.Error("failed to read BUDGETS_CONFIG_PATH", zap.String("path", budgetsConfigPath), zap.Error(err))
+		return
+	}
+
+	var cfg budgetsConfig
+	if strings.HasSuffix(budgetsConfigPath, ".json") {
+		err = json.Unmarshal(raw, &cfg)
+	} else {
+		err = yaml.Unmarshal(raw, &cfg)
+	}
+	if err != nil {
+		baseLogger.Error("failed to parse BUDGETS_CONFIG_PATH", zap.String("path", budgetsConfigPath), zap.Error(err))
+		return
+	}
+
+	budgetsMu.Lock()
+	budgetsCfg = cfg
+	budgetsMu.Unlock()
+	baseLogger.Info("loaded budgets config", zap.String("path", budgetsConfigPath), zap.Int("tenant_overrides", len(cfg.Tenants)))
+}
+
+// tenantBudgetRate returns the rate/burst to enforce for tenant, falling back
+// first to the config's "default" entry, then to the global
+// BUDGET_RATE_BYTES_PER_SEC/BUDGET_BURST_BYTES env defaults.
+func tenantBudgetRate(tenant string) (rate float64, burst int64) {
+	budgetsMu.RLock()
+	defer budgetsMu.RUnlock()
+
+	if tb, ok := budgetsCfg.Tenants[tenant]; ok {
+		return tb.RateBytesPerSec, tb.BurstBytes
+	}
+	if budgetsCfg.Default.RateBytesPerSec > 0 {
+		return budgetsCfg.Default.RateBytesPerSec, budgetsCfg.Default.BurstBytes
+	}
+	return budgetRateBytesPerSec, budgetBurstBytes
+}
+
+func budgetKeyFor(tenant string) string {
+	return budgetBucketKey + ":" + tenant
+}
+
+// maxTenantLength bounds how much of an attacker-controlled tenant value
+// (X-Tenant-Id or payload service.name) can end up in a Redis key or a
+// Prometheus label.
+const maxTenantLength = 128
+
+// sanitizeTenant must be applied to every tenant value before it's used as a
+// budget key or metric label. It truncates to maxTenantLength and, once
+// BUDGETS_CONFIG_PATH declares an explicit tenant list, rejects anything not
+// on that list in favor of defaultTenant -- otherwise any caller can mint an
+// unbounded number of Redis keys and Prometheus label values just by varying
+// the header or service.name, which is exactly the abuse this proxy exists
+// to stop.
+func sanitizeTenant(tenant string) string {
+	if len(tenant) > maxTenantLength {
+		tenant = tenant[:maxTenantLength]
+	}
+
+	budgetsMu.RLock()
+	_, known := budgetsCfg.Tenants[tenant]
+	hasAllowlist := len(budgetsCfg.Tenants) > 0
+	budgetsMu.RUnlock()
+
+	if hasAllowlist && tenant != defaultTenant && !known {
+		return defaultTenant
+	}
+	return tenant
+}
+
+// resolveTenant extracts the tenant for a request: the configured header
+// first, falling back to service.name peeked from the decoded OTLP payload
+// (whatever decodeTraces/decodeLogs already produced for this request, so
+// resolution doesn't need a second decode pass).
+func resolveTenant(headerTenant string, data interface{}) string {
+	if headerTenant != "" {
+		return headerTenant
+	}
+
+	var attrs []*commonpb.KeyValue
+	switch v := data.(type) {
+	case *tracepb.TracesData:
+		if len(v.GetResourceSpans()) > 0 {
+			attrs = v.GetResourceSpans()[0].GetResource().GetAttributes()
+		}
+	case *logspb.LogsData:
+		if len(v.GetResourceLogs()) > 0 {
+			attrs = v.GetResourceLogs()[0].GetResource().GetAttributes()
+		}
+	}
+
+	if svc := attrsToMap(attrs)["service.name"]; svc != "" {
+		return svc
+	}
+	return defaultTenant
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func tracesWithServiceName(name string) *tracepb.TracesData {
+	return &tracepb.TracesData{
+		ResourceSpans: []*tracepb.ResourceSpans{
+			{
+				Resource: &resourcepb.Resource{
+					Attributes: []*commonpb.KeyValue{
+						{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: name}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestResolveTenant(t *testing.T) {
+	cases := []struct {
+		name         string
+		headerTenant string
+		data         interface{}
+		want         string
+	}{
+		{"header wins", "acme", tracesWithServiceName("other"), "acme"},
+		{"falls back to service.name", "", tracesWithServiceName("checkout"), "checkout"},
+		{"falls back to default with no header or service.name", "", &tracepb.TracesData{}, defaultTenant},
+		{"falls back to default on nil data", "", nil, defaultTenant},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := resolveTenant(tc.headerTenant, tc.data)
+			if got != tc.want {
+				t.Errorf("resolveTenant(%q, ...) = %q, want %q", tc.headerTenant, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeTenant(t *testing.T) {
+	budgetsMu.Lock()
+	prev := budgetsCfg
+	budgetsMu.Unlock()
+	defer func() {
+		budgetsMu.Lock()
+		budgetsCfg = prev
+		budgetsMu.Unlock()
+	}()
+
+	t.Run("no allowlist passes through, truncated", func(t *testing.T) {
+		budgetsMu.Lock()
+		budgetsCfg = budgetsConfig{}
+		budgetsMu.Unlock()
+
+		got := sanitizeTenant(strings.Repeat("a", maxTenantLength+10))
+		if len(got) != maxTenantLength {
+			t.Errorf("sanitizeTenant truncated length = %d, want %d", len(got), maxTenantLength)
+		}
+	})
+
+	t.Run("allowlist rejects unknown tenant", func(t *testing.T) {
+		budgetsMu.Lock()
+		budgetsCfg = budgetsConfig{Tenants: map[string]tenantBudget{"acme": {}}}
+		budgetsMu.Unlock()
+
+		if got := sanitizeTenant("attacker-controlled"); got != defaultTenant {
+			t.Errorf("sanitizeTenant(unknown) = %q, want %q", got, defaultTenant)
+		}
+		if got := sanitizeTenant("acme"); got != "acme" {
+			t.Errorf("sanitizeTenant(known) = %q, want %q", got, "acme")
+		}
+	})
+}